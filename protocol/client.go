@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client reads typed Envelopes off a LiteSpeedTest websocket connection, so
+// third-party tools can consume a run's progress and results without
+// screen-scraping the legacy ad-hoc string frames.
+type Client struct {
+	conn *websocket.Conn
+}
+
+// Dial connects to a LiteSpeedTest websocket endpoint (e.g.
+// "ws://host:port/api/ws") and returns a Client ready to read events.
+func Dial(url string) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the underlying websocket connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ReadEvent blocks for the next frame and decodes it into an Envelope. It
+// returns the websocket's close error once the server has sent EventEOF and
+// hung up.
+func (c *Client) ReadEvent() (*Envelope, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeEnvelope(data)
+}
+
+// DecodeEnvelope parses a single raw frame into an Envelope.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
@@ -0,0 +1,178 @@
+// Package protocol defines the typed wire format that LiteSpeedTest's
+// websocket (and REST) endpoints use to report test progress and results.
+// It is deliberately free of any websocket/HTTP dependency so that
+// third-party tools can import it to decode frames without pulling in the
+// server.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ProtocolVersion is bumped whenever the Envelope or event payloads change
+// in a way clients need to branch on.
+const ProtocolVersion = 1
+
+// Status is the top-level outcome carried by every Envelope.
+type Status string
+
+const (
+	StatusOK  Status = "OK"
+	StatusErr Status = "ERR"
+)
+
+// ErrorCode enumerates the failure reasons an ERR envelope can carry, so
+// clients can branch on a stable identifier instead of matching on the
+// human-readable Message.
+type ErrorCode string
+
+const (
+	ErrCodeNone           ErrorCode = ""
+	ErrCodeNoNodes        ErrorCode = "NO_NODES"
+	ErrCodeInvalidLink    ErrorCode = "INVALID_LINK"
+	ErrCodeInvalidRequest ErrorCode = "INVALID_REQUEST"
+	ErrCodePingFailed     ErrorCode = "PING_FAILED"
+	ErrCodeDownloadFailed ErrorCode = "DOWNLOAD_FAILED"
+	ErrCodeTimeout        ErrorCode = "TIMEOUT"
+)
+
+// EventType discriminates the payload carried in an Envelope's Data field.
+type EventType string
+
+const (
+	EventStarted    EventType = "started"
+	EventGotServer  EventType = "gotserver"
+	EventStartPing  EventType = "startping"
+	EventGotPing    EventType = "gotping"
+	EventStartSpeed EventType = "startspeed"
+	EventGotSpeed   EventType = "gotspeed"
+	EventEndOne     EventType = "endone"
+	EventEOF        EventType = "eof"
+	EventPicData    EventType = "picdata"
+	EventArtifact   EventType = "artifact"
+	EventResult     EventType = "result"
+)
+
+// Envelope is the single JSON frame written for every event. Data holds the
+// event-specific payload (one of the Started/GotServer/... structs below),
+// left raw so Unmarshal can be deferred until the caller knows Type.
+type Envelope struct {
+	Version int             `json:"version"`
+	Type    EventType       `json:"type"`
+	Status  Status          `json:"status"`
+	Code    ErrorCode       `json:"code,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Unmarshal decodes the Envelope's Data into v, e.g. a *GotSpeed.
+func (e *Envelope) Unmarshal(v interface{}) error {
+	if len(e.Data) == 0 {
+		return errors.New("protocol: envelope has no data")
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// NewEvent builds an OK envelope of the given type carrying payload.
+func NewEvent(t EventType, payload interface{}) (*Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version: ProtocolVersion,
+		Type:    t,
+		Status:  StatusOK,
+		Data:    data,
+	}, nil
+}
+
+// NewErrorEvent builds an ERR envelope for the given event type, code and
+// underlying error.
+func NewErrorEvent(t EventType, code ErrorCode, err error) *Envelope {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	return &Envelope{
+		Version: ProtocolVersion,
+		Type:    t,
+		Status:  StatusErr,
+		Code:    code,
+		Message: msg,
+	}
+}
+
+// Marshal serializes the envelope as it is written to the wire.
+func (e *Envelope) Marshal() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Started is emitted once, before any per-node events, when a test run
+// begins.
+type Started struct {
+	Count int `json:"count"`
+}
+
+// GotServer is emitted once per node right after the run starts, echoing
+// back the link and group the node was resolved to.
+type GotServer struct {
+	Id    int    `json:"id"`
+	Link  string `json:"link"`
+	Group string `json:"group"`
+}
+
+// StartPing/GotPing bracket the ping phase for a single node.
+type StartPing struct {
+	Id int `json:"id"`
+}
+
+type GotPing struct {
+	Id       int   `json:"id"`
+	ElapseMs int64 `json:"elapseMs"`
+}
+
+// StartSpeed/GotSpeed bracket the download phase for a single node. GotSpeed
+// is emitted repeatedly as samples arrive.
+type StartSpeed struct {
+	Id int `json:"id"`
+}
+
+type GotSpeed struct {
+	Id       int   `json:"id"`
+	AvgSpeed int64 `json:"avgSpeed"`
+	MaxSpeed int64 `json:"maxSpeed"`
+	Speed    int64 `json:"speed"`
+}
+
+// EndOne is emitted once a node has finished all of its phases.
+type EndOne struct {
+	Id int `json:"id"`
+}
+
+// EOF is emitted once, after every node has finished.
+type EOF struct{}
+
+// PicData carries the base64 data-URI of the rendered result image. It is
+// kept as its own event (rather than folded into Artifact) since it is the
+// one render format the original browser frontend understands natively.
+type PicData struct {
+	Data string `json:"data"`
+}
+
+// Artifact carries a non-PNG rendered artifact (json/csv/markdown/html/...)
+// as base64, so it can travel the same typed-envelope path PicData does.
+type Artifact struct {
+	Name string `json:"name"`
+	Mime string `json:"mime"`
+	Data string `json:"data"`
+}
+
+// Result carries the final per-node results as opaque JSON, left raw so
+// protocol stays free of a dependency on the render package's Node type.
+// Consumers that know the shape (e.g. the web package) can unmarshal Nodes
+// into render.Nodes directly.
+type Result struct {
+	Nodes json.RawMessage `json:"nodes"`
+}
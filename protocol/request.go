@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Test modes a TestRequest can select.
+const (
+	ALLTEST = iota
+	RETEST
+)
+
+// Speed test modes.
+const (
+	SpeedOnly = "speedonly"
+	PingOnly  = "pingonly"
+)
+
+// TestRequest is the single, versioned schema clients send to start or
+// retest a run. It replaces the earlier `^`-delimited positional string and
+// the two near-duplicate JSON shapes that used to be parsed by hand.
+type TestRequest struct {
+	Version       int           `json:"version"`
+	GroupName     string        `json:"group"`
+	SpeedTestMode string        `json:"speedtestMode"`
+	PingMethod    string        `json:"pingMethod"`
+	SortMethod    string        `json:"sortMethod"`
+	Concurrency   int           `json:"concurrency"`
+	TestMode      int           `json:"testMode"`
+	TestIDs       []int         `json:"testids"`
+	Timeout       time.Duration `json:"timeout"`
+	Links         []string      `json:"links"`
+	Subscription  string        `json:"subscription"`
+	// Subscriptions lists multiple subscription URLs to fetch and merge
+	// into one run, de-duplicating nodes that resolve to the same
+	// (protocol, host, port, uuid/password). Takes precedence over the
+	// single Subscription field when non-empty.
+	Subscriptions []string `json:"subscriptions"`
+	Language      string   `json:"language"`
+	FontSize      int      `json:"fontSize"`
+	// Renderers lists the result artifact formats to produce for this run,
+	// e.g. ["png", "json", "markdown"]. Defaults to ["png"] when empty.
+	Renderers []string `json:"renderers"`
+	// PingTimeout bounds the ping phase of a single node, independently of
+	// Timeout which otherwise governs the whole node. Zero disables it.
+	PingTimeout time.Duration `json:"pingTimeout"`
+	// HandshakeTimeout and FirstByteTimeout are not enforced separately: the
+	// smaller of the two positive values becomes one deadline that runs from
+	// the start of a node's download until its first speed sample arrives.
+	// The handshake and the first-byte wait are not timed on their own.
+	// Zero for both disables that deadline.
+	HandshakeTimeout time.Duration `json:"handshakeTimeout"`
+	// FirstByteTimeout: see HandshakeTimeout.
+	FirstByteTimeout time.Duration `json:"firstByteTimeout"`
+	// SpeedSampleInterval bounds the gap allowed between successive speed
+	// samples while a node's download is in progress; a stalled transfer
+	// that stops producing samples is treated as failed rather than
+	// consuming the rest of Timeout silently.
+	SpeedSampleInterval time.Duration `json:"speedSampleInterval"`
+}
+
+// ParseTestRequest decodes and defaults a TestRequest from a raw websocket
+// message. It is the single entry point for both the initial test and a
+// retest, replacing the old parseMessage/parseRetestMessage/parseOptions
+// trio.
+func ParseTestRequest(message []byte) (*TestRequest, error) {
+	req := &TestRequest{}
+	if err := json.Unmarshal(message, req); err != nil {
+		return nil, err
+	}
+	req.Timeout = time.Duration(int(req.Timeout)) * time.Second
+	// PingTimeout/HandshakeTimeout/FirstByteTimeout/SpeedSampleInterval are
+	// sent the same way Timeout is: a plain number of seconds, not a
+	// time.Duration literal (nanoseconds).
+	req.PingTimeout = time.Duration(int(req.PingTimeout)) * time.Second
+	req.HandshakeTimeout = time.Duration(int(req.HandshakeTimeout)) * time.Second
+	req.FirstByteTimeout = time.Duration(int(req.FirstByteTimeout)) * time.Second
+	req.SpeedSampleInterval = time.Duration(int(req.SpeedSampleInterval)) * time.Second
+	if req.GroupName == "?empty?" || req.GroupName == "" {
+		req.GroupName = "Default"
+	}
+	minTimeout := 8 * time.Second
+	if req.TestMode == RETEST {
+		minTimeout = 20 * time.Second
+	}
+	if req.Timeout < minTimeout {
+		req.Timeout = minTimeout
+	}
+	if req.Concurrency < 1 {
+		req.Concurrency = 1
+	}
+	if len(req.Renderers) == 0 {
+		req.Renderers = []string{"png"}
+	}
+	return req, nil
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xxf098/lite-proxy/protocol"
+)
+
+// JobServer exposes ProfileTest over a REST surface so CI pipelines and
+// headless dashboards can drive a run without a browser attached to a
+// websocket. It wraps a ResultStore for persistence and keeps a small
+// in-memory table of cancel funcs for jobs that are still running.
+type JobServer struct {
+	Store ResultStore
+	// Metrics, if set, is attached to every ProfileTest this server runs.
+	Metrics *Metrics
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// NewJobServer returns a JobServer backed by store.
+func NewJobServer(store ResultStore) *JobServer {
+	return &JobServer{
+		Store:   store,
+		running: make(map[string]context.CancelFunc),
+	}
+}
+
+// RegisterRoutes wires the REST surface onto mux: POST/GET /api/v1/tests,
+// GET/DELETE /api/v1/tests/{id}, and GET /api/v1/tests/{id}/image.png and
+// .../result.json. It also mounts /metrics when s.Metrics is set.
+func (s *JobServer) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/tests", s.handleTests)
+	mux.HandleFunc("/api/v1/tests/", s.handleTestPath)
+	s.Metrics.RegisterRoute(mux)
+}
+
+// handleTests dispatches the collection endpoint: POST starts a job, GET
+// lists every job the store knows about.
+func (s *JobServer) handleTests(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.handleCreate(w, r)
+	case http.MethodGet:
+		s.handleList(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *JobServer) handleList(w http.ResponseWriter, r *http.Request) {
+	jobs, err := s.Store.List()
+	if err != nil {
+		writeErrJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (s *JobServer) handleTestPath(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/tests/")
+	switch {
+	case strings.HasSuffix(rest, "/image.png"):
+		s.handleImage(w, r, strings.TrimSuffix(rest, "/image.png"))
+	case strings.HasSuffix(rest, "/result.json"):
+		s.handleResult(w, r, strings.TrimSuffix(rest, "/result.json"))
+	default:
+		s.handleJob(w, r, rest)
+	}
+}
+
+func (s *JobServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErrJSON(w, http.StatusBadRequest, err)
+		return
+	}
+	links, options, err := parseTestRequest(body)
+	if err != nil {
+		writeErrJSON(w, http.StatusBadRequest, err)
+		return
+	}
+	job := &Job{
+		Id:        newJobID(),
+		Status:    JobPending,
+		Options:   options,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.Store.Save(job); err != nil {
+		writeErrJSON(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Encode the accepted (still-pending) job before starting it: s.start
+	// hands job to a progressRecorder that mutates it from background
+	// goroutines, so encoding the same pointer afterwards would race that
+	// writer.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+
+	s.start(job, links)
+}
+
+// start launches a job's ProfileTest.testAll in the background, recording
+// progress into the store as it goes and the final result on completion.
+func (s *JobServer) start(job *Job, links []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Options.Timeout*time.Duration(len(links)+1))
+	s.mu.Lock()
+	s.running[job.Id] = cancel
+	s.mu.Unlock()
+
+	job.Status = JobRunning
+	s.Store.Save(job)
+
+	recorder := newProgressRecorder(job)
+	recorder.persist = func(job *Job) { s.Store.Save(job) }
+	p := &ProfileTest{
+		Conn:        recorder,
+		Options:     job.Options,
+		MessageType: 1, // websocket.TextMessage
+		Links:       links,
+		Metrics:     s.Metrics,
+	}
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, job.Id)
+			s.mu.Unlock()
+		}()
+		err := p.testAll(ctx)
+		job.UpdatedAt = time.Now()
+		if recorder.nodes != nil {
+			job.Nodes = recorder.nodes
+		}
+		switch {
+		case ctx.Err() == context.Canceled:
+			job.Status = JobCanceled
+		case err != nil:
+			job.Status = JobError
+			job.Error = err.Error()
+		default:
+			job.Status = JobDone
+		}
+		if len(recorder.imageData) > 0 {
+			s.Store.SaveImage(job.Id, recorder.imageData)
+		}
+		s.Store.Save(job)
+		cancel()
+	}()
+}
+
+func (s *JobServer) handleJob(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		job, err := s.Store.Load(id)
+		if err != nil {
+			writeErrJSON(w, http.StatusNotFound, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case http.MethodDelete:
+		s.mu.Lock()
+		cancel, running := s.running[id]
+		s.mu.Unlock()
+		if running {
+			// Job is still in flight: cancel it rather than deleting its
+			// record outright. Its final state is persisted as JobCanceled
+			// once the run unwinds.
+			cancel()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, err := s.Store.Load(id); err != nil {
+			writeErrJSON(w, http.StatusNotFound, err)
+			return
+		}
+		if err := s.Store.Delete(id); err != nil {
+			writeErrJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *JobServer) handleImage(w http.ResponseWriter, r *http.Request, id string) {
+	png, err := s.Store.LoadImage(id)
+	if err != nil {
+		writeErrJSON(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+func (s *JobServer) handleResult(w http.ResponseWriter, r *http.Request, id string) {
+	job, err := s.Store.Load(id)
+	if err != nil {
+		writeErrJSON(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Nodes)
+}
+
+func writeErrJSON(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	env := protocol.NewErrorEvent("", protocol.ErrCodeInvalidRequest, err)
+	json.NewEncoder(w).Encode(env)
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
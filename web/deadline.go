@@ -0,0 +1,70 @@
+package web
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer is a rearmable, channel-based deadline: Done() closes once
+// the configured duration elapses since the last Set call, and Set rearms
+// it rather than requiring a new timer/channel pair each time. It mirrors
+// the readDeadline/writeDeadline pattern used by this codebase's stream
+// adapters, applied here to the ping/handshake/first-byte phases of a
+// single node's test instead of to a net.Conn.
+//
+// A zero duration disables the deadline: Done() never closes.
+type deadlineTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+// newDeadlineTimer returns a deadlineTimer already armed for d. d <= 0
+// disables it.
+func newDeadlineTimer(d time.Duration) *deadlineTimer {
+	dt := &deadlineTimer{ch: make(chan struct{})}
+	dt.Set(d)
+	return dt
+}
+
+// Set rearms the timer for d from now, replacing any pending deadline. d <=
+// 0 disables it until the next Set.
+func (dt *deadlineTimer) Set(d time.Duration) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.timer != nil {
+		dt.timer.Stop()
+	}
+	dt.ch = make(chan struct{})
+	if d <= 0 {
+		dt.timer = nil
+		return
+	}
+	ch := dt.ch
+	dt.timer = time.AfterFunc(d, func() { closeOnce(ch) })
+}
+
+// Stop disarms the timer; Done() will not close unless Set is called again.
+func (dt *deadlineTimer) Stop() {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.timer != nil {
+		dt.timer.Stop()
+		dt.timer = nil
+	}
+}
+
+// Done returns the channel that closes when the current deadline expires.
+func (dt *deadlineTimer) Done() <-chan struct{} {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	return dt.ch
+}
+
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
@@ -0,0 +1,248 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xxf098/lite-proxy/web/render"
+)
+
+// JobStatus is the lifecycle state of an asynchronous test run started
+// through the REST API.
+type JobStatus string
+
+const (
+	JobPending  JobStatus = "pending"
+	JobRunning  JobStatus = "running"
+	JobDone     JobStatus = "done"
+	JobError    JobStatus = "error"
+	JobCanceled JobStatus = "canceled"
+)
+
+// ErrJobNotFound is returned by a ResultStore when no job exists for an id.
+var ErrJobNotFound = errors.New("web: job not found")
+
+// Job is the REST-facing view of a ProfileTest run: its options, its
+// lifecycle, and whatever results are available so far.
+type Job struct {
+	Id        string               `json:"id"`
+	Status    JobStatus            `json:"status"`
+	Options   *ProfileTestOptions  `json:"options"`
+	Progress  map[int]NodeProgress `json:"progress,omitempty"`
+	Nodes     render.Nodes         `json:"nodes,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+}
+
+// NodeProgress is the latest known state of a single node within a running
+// job, as observed from the typed protocol events it emits.
+type NodeProgress struct {
+	Remarks string `json:"remarks,omitempty"`
+	Stage   string `json:"stage"`
+	Elapse  int64  `json:"elapseMs,omitempty"`
+	Speed   int64  `json:"speed,omitempty"`
+	Done    bool   `json:"done"`
+}
+
+// ResultStore persists Jobs so that results survive process restarts and can
+// be listed or compared historically. Implementations must be safe for
+// concurrent use.
+type ResultStore interface {
+	Save(job *Job) error
+	Load(id string) (*Job, error)
+	List() ([]*Job, error)
+	Delete(id string) error
+	// SaveImage stores the rendered PNG artifact for a job.
+	SaveImage(id string, png []byte) error
+	// LoadImage returns the previously stored PNG artifact for a job.
+	LoadImage(id string) ([]byte, error)
+}
+
+// MemoryResultStore keeps jobs and their artifacts in process memory. It is
+// the default store: fast, but results are lost on restart.
+type MemoryResultStore struct {
+	mu     sync.RWMutex
+	jobs   map[string]*Job
+	images map[string][]byte
+}
+
+// NewMemoryResultStore returns an empty, ready to use MemoryResultStore.
+func NewMemoryResultStore() *MemoryResultStore {
+	return &MemoryResultStore{
+		jobs:   make(map[string]*Job),
+		images: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryResultStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.Id] = cloneJob(job)
+	return nil
+}
+
+func (s *MemoryResultStore) Load(id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return cloneJob(job), nil
+}
+
+func (s *MemoryResultStore) List() ([]*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, cloneJob(job))
+	}
+	return jobs, nil
+}
+
+// cloneJob deep-copies the fields of job that are still mutable after the
+// Job has been handed to a store: Progress and Nodes. A plain `cp := *job`
+// only copies the map/slice headers, so a stored or returned Job would keep
+// aliasing the live map a running job's progressRecorder writes to under its
+// own lock — racing any concurrent Save/Load against that writer. The
+// recorder's persist hook calls Save from inside that lock, so the copy made
+// here is taken while the recorder is not writing; JobServer's other Save
+// calls do not hold that lock. Once cloned, the stored Job no longer shares
+// memory with the recorder's.
+func cloneJob(job *Job) *Job {
+	cp := *job
+	if job.Progress != nil {
+		cp.Progress = make(map[int]NodeProgress, len(job.Progress))
+		for id, p := range job.Progress {
+			cp.Progress[id] = p
+		}
+	}
+	if job.Nodes != nil {
+		cp.Nodes = append(render.Nodes(nil), job.Nodes...)
+	}
+	return &cp
+}
+
+func (s *MemoryResultStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	delete(s.images, id)
+	return nil
+}
+
+func (s *MemoryResultStore) SaveImage(id string, png []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[id] = png
+	return nil
+}
+
+func (s *MemoryResultStore) LoadImage(id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	png, ok := s.images[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return png, nil
+}
+
+// FileResultStore persists jobs as `<dir>/<id>.json` and their rendered
+// images as `<dir>/<id>.png`, so results survive process restarts.
+type FileResultStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileResultStore returns a FileResultStore rooted at dir, creating it if
+// necessary.
+func NewFileResultStore(dir string) (*FileResultStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileResultStore{dir: dir}, nil
+}
+
+func (s *FileResultStore) jobPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *FileResultStore) imagePath(id string) string {
+	return filepath.Join(s.dir, id+".png")
+}
+
+func (s *FileResultStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.jobPath(job.Id), data, 0644)
+}
+
+func (s *FileResultStore) Load(id string) (*Job, error) {
+	data, err := ioutil.ReadFile(s.jobPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *FileResultStore) List() ([]*Job, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		job, err := s.Load(id)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *FileResultStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os.Remove(s.jobPath(id))
+	os.Remove(s.imagePath(id))
+	return nil
+}
+
+func (s *FileResultStore) SaveImage(id string, png []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ioutil.WriteFile(s.imagePath(id), png, 0644)
+}
+
+func (s *FileResultStore) LoadImage(id string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.imagePath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrJobNotFound
+	}
+	return data, err
+}
@@ -0,0 +1,123 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsOptions configures the opt-in /metrics endpoint. Metrics are only
+// collected when a *Metrics built from these options is attached to a
+// ProfileTest; a nil *Metrics makes every observe call a no-op so callers
+// that don't care about metrics pay nothing for them.
+type MetricsOptions struct {
+	Enabled bool
+	// Namespace prefixes every metric name, e.g. "litespeedtest". Defaults
+	// to "litespeedtest" when empty.
+	Namespace string
+}
+
+// Metrics holds the Prometheus collectors ProfileTest reports into, so
+// LiteSpeedTest can run as a scheduled health-check job whose output is
+// scraped and alerted on instead of only driven from a browser.
+type Metrics struct {
+	registry               *prometheus.Registry
+	profilesTotal          *prometheus.CounterVec
+	pingMilliseconds       *prometheus.HistogramVec
+	downloadBytesPerSecond *prometheus.HistogramVec
+	testDurationSeconds    prometheus.Histogram
+	guardDepth             *prometheus.GaugeVec
+}
+
+// NewMetrics builds and registers the collectors described by opts. Callers
+// typically keep the result around for the process lifetime and attach it
+// to every ProfileTest they create.
+func NewMetrics(opts MetricsOptions) *Metrics {
+	ns := opts.Namespace
+	if ns == "" {
+		ns = "litespeedtest"
+	}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		profilesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "profiles_total",
+			Help:      "Number of nodes tested, by protocol, group and result.",
+		}, []string{"protocol", "group", "result"}),
+		pingMilliseconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "ping_milliseconds",
+			Help:      "Ping latency per node, by protocol.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"protocol"}),
+		downloadBytesPerSecond: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "download_bytes_per_second",
+			Help:      "Average download speed per node, by protocol.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 2, 20),
+		}, []string{"protocol"}),
+		testDurationSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "test_duration_seconds",
+			Help:      "Wall-clock duration of a full ProfileTest run.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		guardDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Name:      "guard_depth",
+			Help:      "In-flight concurrency slots in use, by group.",
+		}, []string{"group"}),
+	}
+	m.registry.MustRegister(m.profilesTotal, m.pingMilliseconds, m.downloadBytesPerSecond, m.testDurationSeconds, m.guardDepth)
+	return m
+}
+
+// RegisterRoute mounts the /metrics endpoint on mux. A nil *Metrics is a
+// no-op, so callers can unconditionally call this even when metrics are
+// disabled.
+func (m *Metrics) RegisterRoute(mux *http.ServeMux) {
+	if m == nil {
+		return
+	}
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+func (m *Metrics) observeProfile(protocol, group string, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if !ok {
+		result = "fail"
+	}
+	m.profilesTotal.WithLabelValues(protocol, group, result).Inc()
+}
+
+func (m *Metrics) observePing(protocol string, elapseMs int64) {
+	if m == nil {
+		return
+	}
+	m.pingMilliseconds.WithLabelValues(protocol).Observe(float64(elapseMs))
+}
+
+func (m *Metrics) observeSpeed(protocol string, bytesPerSecond int64) {
+	if m == nil {
+		return
+	}
+	m.downloadBytesPerSecond.WithLabelValues(protocol).Observe(float64(bytesPerSecond))
+}
+
+func (m *Metrics) observeDuration(seconds float64) {
+	if m == nil {
+		return
+	}
+	m.testDurationSeconds.Observe(seconds)
+}
+
+func (m *Metrics) setGuardDepth(group string, depth int) {
+	if m == nil {
+		return
+	}
+	m.guardDepth.WithLabelValues(group).Set(float64(depth))
+}
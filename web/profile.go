@@ -7,23 +7,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/xxf098/lite-proxy/common"
 	"github.com/xxf098/lite-proxy/download"
+	"github.com/xxf098/lite-proxy/protocol"
 	"github.com/xxf098/lite-proxy/request"
 	"github.com/xxf098/lite-proxy/web/render"
 )
 
 var ErrInvalidData = errors.New("invalid data")
+var ErrNoNodes = errors.New("no profile found")
+var ErrPingOnly = errors.New(PingOnly)
 
 // support proxy
 // concurrency setting
@@ -58,95 +58,66 @@ func parseLinks(message string) ([]string, error) {
 	if matched && err == nil {
 		return getSubscriptionLinks(message)
 	}
-	reg := regexp.MustCompile(`((?i)(vmess|ssr)://[a-zA-Z0-9+_/=-]+)|((?i)(ss|trojan)://(.+?)@(.+?):([0-9]{2,5})([?#][^\s]+))`)
-	matches := reg.FindAllStringSubmatch(message, -1)
-	links := make([]string, len(matches))
-	for index, match := range matches {
-		links[index] = match[0]
-	}
+	links := extractLinks(message)
 	if len(links) < 1 {
 		return nil, ErrInvalidData
 	}
 	return links, nil
 }
 
-func parseOptions(message string) (*ProfileTestOptions, error) {
-	opts := strings.Split(message, "^")
-	if len(opts) < 7 {
-		return nil, ErrInvalidData
-	}
-	groupName := opts[0]
-	if groupName == "?empty?" || groupName == "" {
-		groupName = "Default"
-	}
-	concurrency, err := strconv.Atoi(opts[5])
-	if err != nil {
-		return nil, err
-	}
-	if concurrency < 1 {
-		concurrency = 1
-	}
-	timeout, err := strconv.Atoi(opts[6])
-	if err != nil {
-		return nil, err
-	}
-	if timeout < 20 {
-		timeout = 20
-	}
-	testOpt := &ProfileTestOptions{
-		GroupName:     groupName,
-		SpeedTestMode: opts[1],
-		PingMethod:    opts[2],
-		SortMethod:    opts[3],
-		Concurrency:   concurrency,
-		TestMode:      ALLTEST,
-		Timeout:       time.Duration(timeout) * time.Second,
+// linkPattern matches the proxy URI schemes this package understands,
+// embedded anywhere in a block of text (one per line, or otherwise).
+var linkPattern = regexp.MustCompile(`((?i)(vmess|ssr)://[a-zA-Z0-9+_/=-]+)|((?i)(ss|trojan|vless)://(.+?)@(.+?):([0-9]{2,5})([?#][^\s]+))`)
+
+// extractLinks pulls every proxy URI out of message. It is shared by
+// parseLinks (single legacy Subscription field) and SubscriptionFetcher
+// (multiple Subscriptions, any of the formats it auto-detects).
+func extractLinks(message string) []string {
+	matches := linkPattern.FindAllStringSubmatch(message, -1)
+	links := make([]string, len(matches))
+	for index, match := range matches {
+		links[index] = match[0]
 	}
-	return testOpt, nil
+	return links
 }
 
+// Test mode and speed-test mode constants, re-exported from protocol so
+// existing callers in this package don't need the extra qualifier.
 const (
-	SpeedOnly = "speedonly"
-	PingOnly  = "pingonly"
-	ALLTEST   = iota
-	RETEST
+	SpeedOnly = protocol.SpeedOnly
+	PingOnly  = protocol.PingOnly
+	ALLTEST   = protocol.ALLTEST
+	RETEST    = protocol.RETEST
 )
 
-type ProfileTestOptions struct {
-	GroupName     string        `json:"group"`
-	SpeedTestMode string        `json:"speedtestMode"`
-	PingMethod    string        `json:"pingMethod"`
-	SortMethod    string        `json:"sortMethod"`
-	Concurrency   int           `json:"concurrency"`
-	TestMode      int           `json:"testMode"`
-	TestIDs       []int         `json:"testids"`
-	Timeout       time.Duration `json:"timeout"`
-	Links         []string      `json:"links"`
-	Subscription  string        `json:"subscription"`
-	Language      string        `json:"language"`
-	FontSize      int           `json:"fontSize"`
-}
+// ProfileTestOptions is the decoded, defaulted form of a client's test
+// request. It is an alias of protocol.TestRequest: the wire schema and the
+// in-process options are the same versioned shape.
+type ProfileTestOptions = protocol.TestRequest
 
-func parseMessage(message []byte) ([]string, *ProfileTestOptions, error) {
-	options := &ProfileTestOptions{}
-	err := json.Unmarshal(message, options)
+// parseTestRequest decodes a websocket message into the links to test plus
+// its options. It replaces the old parseMessage/parseRetestMessage pair
+// (and the brittle `^`-split parseOptions before them) now that both the
+// initial test and a retest share one versioned protocol.TestRequest.
+func parseTestRequest(message []byte) ([]string, *ProfileTestOptions, error) {
+	options, err := protocol.ParseTestRequest(message)
 	if err != nil {
 		return nil, nil, err
 	}
-	options.Timeout = time.Duration(int(options.Timeout)) * time.Second
-	if options.GroupName == "?empty?" || options.GroupName == "" {
-		options.GroupName = "Default"
-	}
-	if options.Timeout < 8 {
-		options.Timeout = 8
-	}
-	if options.Concurrency < 1 {
-		options.Concurrency = 1
-	}
 	if options.TestMode == RETEST {
 		return options.Links, options, nil
 	}
 	options.TestMode = ALLTEST
+	if len(options.Links) > 0 {
+		return options.Links, options, nil
+	}
+	if len(options.Subscriptions) > 0 {
+		links, err := defaultSubscriptionFetcher.FetchAll(options.Subscriptions)
+		if err != nil {
+			return nil, nil, err
+		}
+		return links, options, nil
+	}
 	links, err := parseLinks(options.Subscription)
 	if err != nil {
 		return nil, nil, err
@@ -154,36 +125,23 @@ func parseMessage(message []byte) ([]string, *ProfileTestOptions, error) {
 	return links, options, nil
 }
 
-func parseRetestMessage(message []byte) ([]string, *ProfileTestOptions, error) {
-	options := &ProfileTestOptions{}
-	err := json.Unmarshal(message, options)
-	if err != nil {
-		return nil, nil, err
-	}
-	if options.TestMode != RETEST {
-		return nil, nil, errors.New("not retest mode")
-	}
-	options.TestMode = RETEST
-	options.Timeout = time.Duration(int(options.Timeout)) * time.Second
-	if options.GroupName == "?empty?" || options.GroupName == "" {
-		options.GroupName = "Default"
-	}
-	if options.Timeout < 20 {
-		options.Timeout = 20
-	}
-	if options.Concurrency < 1 {
-		options.Concurrency = 1
-	}
-	return options.Links, options, nil
+// Conn is the minimal interface ProfileTest needs to emit progress frames.
+// *websocket.Conn satisfies it; the REST job runner supplies a
+// progressRecorder instead so the same test loop can drive either transport.
+type Conn interface {
+	WriteMessage(messageType int, data []byte) error
 }
 
 type ProfileTest struct {
-	Conn        *websocket.Conn
+	Conn        Conn
 	Options     *ProfileTestOptions
 	MessageType int
 	Links       []string
-	mu          sync.Mutex
-	wg          sync.WaitGroup // wait for all to finish
+	// Metrics receives per-run Prometheus observations. A nil Metrics is a
+	// no-op, so callers that didn't opt into MetricsOptions pay nothing.
+	Metrics *Metrics
+	mu      sync.Mutex
+	wg      sync.WaitGroup // wait for all to finish
 }
 
 func (p *ProfileTest) WriteMessage(data []byte) error {
@@ -198,16 +156,40 @@ func (p *ProfileTest) WriteString(data string) error {
 	return p.WriteMessage(b)
 }
 
+// writeEvent marshals an OK envelope for the given event type and payload
+// and writes it to the connection.
+func (p *ProfileTest) writeEvent(t protocol.EventType, payload interface{}) error {
+	env, err := protocol.NewEvent(t, payload)
+	if err != nil {
+		return err
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		return err
+	}
+	return p.WriteMessage(data)
+}
+
+// writeError marshals an ERR envelope carrying code and err's message and
+// writes it to the connection.
+func (p *ProfileTest) writeError(t protocol.EventType, code protocol.ErrorCode, err error) error {
+	data, merr := protocol.NewErrorEvent(t, code, err).Marshal()
+	if merr != nil {
+		return merr
+	}
+	return p.WriteMessage(data)
+}
+
 func (p *ProfileTest) testAll(ctx context.Context) error {
 	if len(p.Links) < 1 {
-		p.WriteString(SPEEDTEST_ERROR_NONODES)
-		return fmt.Errorf("no profile found")
+		p.writeError(protocol.EventStarted, protocol.ErrCodeNoNodes, ErrNoNodes)
+		return ErrNoNodes
 	}
 	start := time.Now()
-	p.WriteMessage(getMsgByte(-1, "started"))
 	linksCount := len(p.Links)
+	p.writeEvent(protocol.EventStarted, protocol.Started{Count: linksCount})
 	for i := range p.Links {
-		p.WriteMessage(gotserverMsg(i, p.Links[i], p.Options.GroupName))
+		p.writeEvent(protocol.EventGotServer, protocol.GotServer{Id: i, Link: p.Links[i], Group: p.Options.GroupName})
 	}
 	guard := make(chan int, p.Options.Concurrency)
 	nodeChan := make(chan render.Node, linksCount)
@@ -223,18 +205,19 @@ func (p *ProfileTest) testAll(ctx context.Context) error {
 		}
 		select {
 		case guard <- i:
+			p.Metrics.setGuardDepth(p.Options.GroupName, len(guard))
 			go func(id int, link string, c <-chan int, nodeChan chan<- render.Node) {
 				p.testOne(ctx, id, link, nodeChan)
-				_ = p.WriteMessage(getMsgByte(id, "endone"))
+				_ = p.writeEvent(protocol.EventEndOne, protocol.EndOne{Id: id})
 				<-c
+				p.Metrics.setGuardDepth(p.Options.GroupName, len(guard))
 			}(id, link, guard, nodeChan)
 		case <-ctx.Done():
 			return nil
 		}
 	}
 	p.wg.Wait()
-	p.WriteMessage(getMsgByte(-1, "eof"))
-	// draw png
+	p.writeEvent(protocol.EventEOF, protocol.EOF{})
 	successCount := 0
 	var traffic int64 = 0
 	for i := 0; i < linksCount; i++ {
@@ -246,24 +229,53 @@ func (p *ProfileTest) testAll(ctx context.Context) error {
 		}
 	}
 	close(nodeChan)
-
-	options := render.NewTableOptions(40, 30, 0.5, 0.5, p.Options.FontSize, 0.5, "./web/misc/WenQuanYiMicroHei-01.ttf", p.Options.Language)
-	table, err := render.NewTableWithOption(nodes, &options)
-	if err != nil {
-		return err
-	}
-	duration := formatDuration(time.Since(start))
-	// msg := fmt.Sprintf("Total Traffic : %s. Total Time : %s. Working Nodes: [%d/%d]", download.ByteCountIECTrim(traffic), duration, successCount, linksCount)
-	msg := table.FormatTraffic(download.ByteCountIECTrim(traffic), duration, fmt.Sprintf("%d/%d", successCount, linksCount))
-	filepath := "out1.png"
-	// save to base64
-	table.Draw(filepath, msg)
-	if picdata, err := png2base64(filepath); err == nil {
-		p.WriteMessage(getMsgByte(-1, "picdata", picdata))
+	if nodesJSON, err := json.Marshal(nodes); err == nil {
+		p.writeEvent(protocol.EventResult, protocol.Result{Nodes: nodesJSON})
 	}
+
+	elapsed := time.Since(start)
+	p.Metrics.observeDuration(elapsed.Seconds())
+	summary := Summary{
+		Traffic:      traffic,
+		Duration:     formatDuration(elapsed),
+		SuccessCount: successCount,
+		TotalCount:   linksCount,
+	}
+	if runSummaryJSON, err := json.Marshal(buildRunSummary(nodes, summary)); err == nil {
+		p.writeEvent(protocol.EventArtifact, protocol.Artifact{Name: "summary", Mime: "application/json", Data: base64.StdEncoding.EncodeToString(runSummaryJSON)})
+	}
+	p.render(nodes, summary)
 	return nil
 }
 
+// render runs every renderer the request asked for and writes its artifact
+// as a typed event: "png" keeps the legacy picdata event the browser
+// frontend understands, everything else goes out as a generic artifact
+// event. Unknown renderer names are skipped rather than failing the run.
+func (p *ProfileTest) render(nodes render.Nodes, summary Summary) {
+	for _, name := range p.Options.Renderers {
+		r, ok := RendererFor(name)
+		if !ok {
+			continue
+		}
+		if pr, ok := r.(pngRenderer); ok {
+			pr.FontSize = p.Options.FontSize
+			pr.Language = p.Options.Language
+			r = pr
+		}
+		data, mime, err := r.Render(nodes, summary)
+		if err != nil {
+			continue
+		}
+		encoded := base64.StdEncoding.EncodeToString(data)
+		if name == "png" {
+			p.writeEvent(protocol.EventPicData, protocol.PicData{Data: "data:" + mime + ";base64," + encoded})
+			continue
+		}
+		p.writeEvent(protocol.EventArtifact, protocol.Artifact{Name: name, Mime: mime, Data: encoded})
+	}
+}
+
 func (p *ProfileTest) testOne(ctx context.Context, index int, link string, nodeChan chan<- render.Node) error {
 	// panic
 	defer p.wg.Done()
@@ -271,17 +283,18 @@ func (p *ProfileTest) testOne(ctx context.Context, index int, link string, nodeC
 		link = p.Links[index]
 		link = strings.SplitN(link, "^", 2)[0]
 	}
-	protocol, remarks, err := getRemarks(link)
+	nodeProtocol, remarks, err := getRemarks(link)
 	if err != nil {
 		remarks = fmt.Sprintf("Profile %d", index)
 	}
-	elapse, err := p.pingLink(index, link)
+	elapse, err := p.pingLink(ctx, index, link)
 	if err != nil {
+		p.Metrics.observeProfile(nodeProtocol, p.Options.GroupName, false)
 		node := render.Node{
 			Id:       index,
 			Group:    p.Options.GroupName,
 			Remarks:  remarks,
-			Protocol: protocol,
+			Protocol: nodeProtocol,
 			Ping:     fmt.Sprintf("%d", elapse),
 			AvgSpeed: 0,
 			MaxSpeed: 0,
@@ -290,13 +303,28 @@ func (p *ProfileTest) testOne(ctx context.Context, index int, link string, nodeC
 		nodeChan <- node
 		return err
 	}
-	err = p.WriteMessage(getMsgByte(index, "startspeed"))
+	p.Metrics.observePing(nodeProtocol, elapse)
+	err = p.writeEvent(protocol.EventStartSpeed, protocol.StartSpeed{Id: index})
+
+	// firstByte bounds the handshake + wait for the first downloaded byte;
+	// sampleGap bounds the quiet time allowed between later speed samples so
+	// a stalled transfer doesn't silently consume the rest of the node's
+	// overall Timeout. Both are rearmed/stopped as samples arrive below.
+	firstByte := newDeadlineTimer(minPositive(p.Options.HandshakeTimeout, p.Options.FirstByteTimeout))
+	sampleGap := newDeadlineTimer(0)
+	defer firstByte.Stop()
+	defer sampleGap.Stop()
+
 	ch := make(chan int64, 1)
-	defer close(ch)
+	sampleDone := make(chan struct{})
+	var phaseErr error
 	go func(ch <-chan int64) {
+		defer close(sampleDone)
 		var max int64
 		var sum int64
 		var avg int64
+		failed := false
+		first := true
 		start := time.Now()
 	Loop:
 		for {
@@ -305,6 +333,11 @@ func (p *ProfileTest) testOne(ctx context.Context, index int, link string, nodeC
 				if !ok || speed < 0 {
 					break Loop
 				}
+				if first {
+					firstByte.Stop()
+					first = false
+				}
+				sampleGap.Set(p.Options.SpeedSampleInterval)
 				sum += speed
 				duration := float64(time.Since(start)/time.Millisecond) / float64(1000)
 				avg = int64(float64(sum) / duration)
@@ -312,49 +345,142 @@ func (p *ProfileTest) testOne(ctx context.Context, index int, link string, nodeC
 					max = speed
 				}
 				log.Printf("%s recv: %s", remarks, download.ByteCountIEC(speed))
-				err = p.WriteMessage(getMsgByte(index, "gotspeed", avg, max, speed))
+				err = p.writeEvent(protocol.EventGotSpeed, protocol.GotSpeed{Id: index, AvgSpeed: avg, MaxSpeed: max, Speed: speed})
+			case <-firstByte.Done():
+				phaseErr = fmt.Errorf("%s: handshake/first-byte timeout", remarks)
+				p.writeError(protocol.EventGotSpeed, protocol.ErrCodeTimeout, phaseErr)
+				failed = true
+				break Loop
+			case <-sampleGap.Done():
+				phaseErr = fmt.Errorf("%s: speed sample timeout", remarks)
+				p.writeError(protocol.EventGotSpeed, protocol.ErrCodeTimeout, phaseErr)
+				failed = true
+				break Loop
 			case <-ctx.Done():
 				log.Printf("index %d done!", index)
+				phaseErr = ctx.Err()
+				failed = true
 				break Loop
 			}
 		}
+		p.Metrics.observeProfile(nodeProtocol, p.Options.GroupName, !failed)
+		if !failed {
+			p.Metrics.observeSpeed(nodeProtocol, avg)
+		}
 		node := render.Node{
 			Id:       index,
 			Group:    p.Options.GroupName,
 			Remarks:  remarks,
-			Protocol: protocol,
+			Protocol: nodeProtocol,
 			Ping:     fmt.Sprintf("%d", elapse),
 			AvgSpeed: avg,
 			MaxSpeed: max,
-			IsOk:     true,
+			IsOk:     !failed,
 			Traffic:  sum,
 		}
 		nodeChan <- node
 	}(ch)
-	speed, err := download.Download(link, p.Options.Timeout, p.Options.Timeout, ch)
-	if speed < 1 {
-		p.WriteMessage(getMsgByte(index, "gotspeed", -1, -1, 0))
+
+	// download.Download blocks synchronously for up to Timeout and has no
+	// cancel hook of its own, so it is run on its own goroutine and raced
+	// against sampleDone: the moment a phase deadline (or ctx) ends the
+	// sample loop above, testOne returns instead of waiting out the rest of
+	// Timeout for a transfer whose result nothing downstream wants anymore.
+	// The orphaned goroutine still drains into ch until Download gives up on
+	// its own, the same abandon-and-move-on shape pingLink uses for ping.
+	type downloadResult struct {
+		speed int64
+		err   error
+	}
+	downloadDone := make(chan downloadResult, 1)
+	go func() {
+		speed, err := download.Download(link, p.Options.Timeout, p.Options.Timeout, ch)
+		downloadDone <- downloadResult{speed, err}
+	}()
+
+	select {
+	case res := <-downloadDone:
+		// download.Download has returned, so it will not send on ch again;
+		// safe to close now. This must happen before <-sampleDone: when no
+		// phase deadline is configured the reader is parked on <-ch with
+		// nothing else to wake it, and download.Download never closes ch
+		// itself (the baseline's own deferred close proved that) nor sends a
+		// terminating sentinel, so closing it is what lets Loop's `!ok`
+		// branch fire and sampleDone close in turn.
+		close(ch)
+		<-sampleDone
+		if res.speed < 1 {
+			p.writeError(protocol.EventGotSpeed, protocol.ErrCodeDownloadFailed, res.err)
+		}
+		return res.err
+	case <-sampleDone:
+		// A phase deadline or ctx fired before download.Download returned.
+		// ch is left open rather than closed: the orphaned goroutine above
+		// may still be sending into it, and closing here would race a panic
+		// against that send. It is drained and garbage-collected once
+		// download.Download itself gives up, bounded by Timeout.
+		return phaseErr
 	}
-	return err
 }
 
-func (p *ProfileTest) pingLink(index int, link string) (int64, error) {
+// minPositive returns the smaller of a, b, treating <= 0 as "unset" rather
+// than zero; it is used to combine HandshakeTimeout and FirstByteTimeout
+// into the single deadline this layer can enforce until download.Download
+// grows hooks for each phase individually.
+func minPositive(a, b time.Duration) time.Duration {
+	switch {
+	case a <= 0:
+		return b
+	case b <= 0:
+		return a
+	case a < b:
+		return a
+	default:
+		return b
+	}
+}
+
+func (p *ProfileTest) pingLink(ctx context.Context, index int, link string) (int64, error) {
 	if p.Options.SpeedTestMode == SpeedOnly {
 		return 0, nil
 	}
 	if link == "" {
 		link = p.Links[index]
 	}
-	p.WriteMessage(getMsgByte(index, "startping"))
-	elapse, err := request.PingLink(link, 2)
-	p.WriteMessage(getMsgByte(index, "gotping", elapse))
+	p.writeEvent(protocol.EventStartPing, protocol.StartPing{Id: index})
+
+	type pingResult struct {
+		elapse int64
+		err    error
+	}
+	resultCh := make(chan pingResult, 1)
+	go func() {
+		elapse, err := request.PingLink(link, 2)
+		resultCh <- pingResult{elapse, err}
+	}()
+
+	var elapse int64
+	var err error
+	pingDeadline := newDeadlineTimer(p.Options.PingTimeout)
+	defer pingDeadline.Stop()
+	select {
+	case res := <-resultCh:
+		elapse, err = res.elapse, res.err
+	case <-pingDeadline.Done():
+		p.writeError(protocol.EventGotPing, protocol.ErrCodeTimeout, fmt.Errorf("ping timeout after %s", p.Options.PingTimeout))
+		return 0, context.DeadlineExceeded
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	p.writeEvent(protocol.EventGotPing, protocol.GotPing{Id: index, ElapseMs: elapse})
 	if elapse < 1 {
-		p.WriteMessage(getMsgByte(index, "gotspeed", -1, -1, 0))
+		p.writeError(protocol.EventGotSpeed, protocol.ErrCodePingFailed, err)
 		return 0, err
 	}
 	if p.Options.SpeedTestMode == PingOnly {
-		p.WriteMessage(getMsgByte(index, "gotspeed", -1, -1, 0))
-		return 0, errors.New(PingOnly)
+		p.writeError(protocol.EventGotSpeed, protocol.ErrCodeNone, ErrPingOnly)
+		return 0, ErrPingOnly
 	}
 	return elapse, err
 }
@@ -370,11 +496,3 @@ func formatDuration(duration time.Duration) string {
 	}
 	return fmt.Sprintf("%dm %ds", m, s)
 }
-
-func png2base64(path string) (string, error) {
-	bytes, err := ioutil.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(bytes), nil
-}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/xxf098/lite-proxy/protocol"
+	"github.com/xxf098/lite-proxy/web/render"
+)
+
+// progressRecorder is a Conn that, instead of writing to a websocket,
+// decodes each typed envelope and folds it into a Job's per-node Progress
+// map. It lets the REST job runner drive the exact same ProfileTest.testAll
+// loop the websocket handler uses. It also captures the terminal result and
+// picture events so JobServer can persist them once the run finishes.
+type progressRecorder struct {
+	mu        sync.Mutex
+	job       *Job
+	nodes     render.Nodes
+	imageData []byte
+	// persist, if set, is called with job still held under mu after every
+	// event folds into it, so a GET mid-run observes current per-node
+	// progress instead of only whatever the last pending/done Save wrote.
+	persist func(*Job)
+}
+
+func newProgressRecorder(job *Job) *progressRecorder {
+	return &progressRecorder{job: job}
+}
+
+// WriteMessage implements Conn.
+func (r *progressRecorder) WriteMessage(_ int, data []byte) error {
+	env, err := protocol.DecodeEnvelope(data)
+	if err != nil {
+		return nil // best-effort: progress tracking must never fail the run
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.apply(env)
+	if r.persist != nil {
+		r.persist(r.job)
+	}
+	return nil
+}
+
+// apply folds env into r.job. Callers must hold r.mu.
+func (r *progressRecorder) apply(env *protocol.Envelope) {
+	if r.job.Progress == nil {
+		r.job.Progress = make(map[int]NodeProgress)
+	}
+	switch env.Type {
+	case protocol.EventGotServer:
+		var p protocol.GotServer
+		if env.Unmarshal(&p) == nil {
+			r.job.Progress[p.Id] = NodeProgress{Stage: string(protocol.EventGotServer)}
+		}
+	case protocol.EventStartPing, protocol.EventGotPing, protocol.EventStartSpeed:
+		r.setStage(env)
+	case protocol.EventGotSpeed:
+		var p protocol.GotSpeed
+		if env.Unmarshal(&p) == nil {
+			np := r.job.Progress[p.Id]
+			np.Stage = string(protocol.EventGotSpeed)
+			np.Speed = p.Speed
+			r.job.Progress[p.Id] = np
+		}
+	case protocol.EventEndOne:
+		var p protocol.EndOne
+		if env.Unmarshal(&p) == nil {
+			np := r.job.Progress[p.Id]
+			np.Stage = string(protocol.EventEndOne)
+			np.Done = true
+			r.job.Progress[p.Id] = np
+		}
+	case protocol.EventResult:
+		var p protocol.Result
+		if env.Unmarshal(&p) == nil {
+			var nodes render.Nodes
+			if json.Unmarshal(p.Nodes, &nodes) == nil {
+				r.nodes = nodes
+			}
+		}
+	case protocol.EventPicData:
+		var p protocol.PicData
+		if env.Unmarshal(&p) == nil {
+			r.imageData = decodeDataURI(p.Data)
+		}
+	}
+}
+
+// decodeDataURI strips the "data:image/png;base64," prefix ProfileTest.render
+// puts on the png renderer's picdata event and decodes the remainder,
+// returning nil if it isn't valid base64.
+func decodeDataURI(uri string) []byte {
+	const prefix = "data:image/png;base64,"
+	b64 := strings.TrimPrefix(uri, prefix)
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// setStage records Type as the current stage for the id carried by any
+// payload shaped like {id int}.
+func (r *progressRecorder) setStage(env *protocol.Envelope) {
+	var p struct {
+		Id int `json:"id"`
+	}
+	if env.Unmarshal(&p) != nil {
+		return
+	}
+	np := r.job.Progress[p.Id]
+	np.Stage = string(env.Type)
+	r.job.Progress[p.Id] = np
+}
@@ -0,0 +1,147 @@
+package web
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+
+	"github.com/xxf098/lite-proxy/download"
+	"github.com/xxf098/lite-proxy/web/render"
+)
+
+// Summary carries the run-level numbers a Renderer may want to show
+// alongside the per-node table, mirroring what the PNG table's footer has
+// always printed.
+type Summary struct {
+	Traffic      int64  `json:"traffic"`
+	Duration     string `json:"duration"`
+	SuccessCount int    `json:"successCount"`
+	TotalCount   int    `json:"totalCount"`
+}
+
+// Renderer turns a finished run's nodes into a rendered artifact. Each
+// implementation owns its own MIME type; callers decide what to do with the
+// bytes (write to a websocket frame, a REST response, or a file).
+type Renderer interface {
+	Render(nodes render.Nodes, summary Summary) ([]byte, string, error)
+}
+
+// renderers is the built-in registry, keyed by the name a ProfileTestOptions
+// picks in its Renderers field.
+var renderers = map[string]Renderer{
+	"png":      pngRenderer{},
+	"json":     jsonRenderer{},
+	"csv":      csvRenderer{},
+	"markdown": markdownRenderer{},
+	"html":     htmlRenderer{},
+}
+
+// RendererFor looks up a built-in Renderer by name.
+func RendererFor(name string) (Renderer, bool) {
+	r, ok := renderers[name]
+	return r, ok
+}
+
+// pngRenderer reproduces the original hard-coded table image, minus the
+// out1.png global temp file: it draws to a throwaway temp file and reads the
+// bytes back, rather than leaving an artifact in the working directory.
+type pngRenderer struct {
+	FontSize int
+	Language string
+}
+
+func (r pngRenderer) Render(nodes render.Nodes, summary Summary) ([]byte, string, error) {
+	options := render.NewTableOptions(40, 30, 0.5, 0.5, r.FontSize, 0.5, "./web/misc/WenQuanYiMicroHei-01.ttf", r.Language)
+	table, err := render.NewTableWithOption(nodes, &options)
+	if err != nil {
+		return nil, "", err
+	}
+	msg := table.FormatTraffic(
+		download.ByteCountIECTrim(summary.Traffic),
+		summary.Duration,
+		fmt.Sprintf("%d/%d", summary.SuccessCount, summary.TotalCount),
+	)
+	tmp, err := ioutil.TempFile("", "litespeedtest-*.png")
+	if err != nil {
+		return nil, "", err
+	}
+	path := tmp.Name()
+	tmp.Close()
+	defer os.Remove(path)
+	table.Draw(path, msg)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/png", nil
+}
+
+// jsonRenderer emits the raw Nodes plus the run Summary, for CI pipelines
+// and other machine consumers.
+type jsonRenderer struct{}
+
+func (jsonRenderer) Render(nodes render.Nodes, summary Summary) ([]byte, string, error) {
+	data, err := json.Marshal(struct {
+		Nodes   render.Nodes `json:"nodes"`
+		Summary Summary      `json:"summary"`
+	}{nodes, summary})
+	return data, "application/json", err
+}
+
+// csvRenderer emits one row per node.
+type csvRenderer struct{}
+
+func (csvRenderer) Render(nodes render.Nodes, summary Summary) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "group", "remarks", "protocol", "ping", "avgSpeed", "maxSpeed", "ok"})
+	for _, n := range nodes {
+		w.Write([]string{
+			fmt.Sprintf("%d", n.Id),
+			n.Group,
+			n.Remarks,
+			n.Protocol,
+			n.Ping,
+			fmt.Sprintf("%d", n.AvgSpeed),
+			fmt.Sprintf("%d", n.MaxSpeed),
+			fmt.Sprintf("%t", n.IsOk),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), "text/csv", w.Error()
+}
+
+// markdownRenderer emits a table suitable for pasting into a chat client or
+// forum post.
+type markdownRenderer struct{}
+
+func (markdownRenderer) Render(nodes render.Nodes, summary Summary) ([]byte, string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "| Remarks | Protocol | Ping | Avg Speed | Max Speed |\n")
+	fmt.Fprintf(&buf, "|---|---|---|---|---|\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&buf, "| %s | %s | %sms | %d | %d |\n", n.Remarks, n.Protocol, n.Ping, n.AvgSpeed, n.MaxSpeed)
+	}
+	fmt.Fprintf(&buf, "\n%d/%d working, %s, %s\n", summary.SuccessCount, summary.TotalCount, download.ByteCountIECTrim(summary.Traffic), summary.Duration)
+	return buf.Bytes(), "text/markdown", nil
+}
+
+// htmlRenderer emits a self-contained HTML table (no external assets), for
+// embedding in a dashboard.
+type htmlRenderer struct{}
+
+func (htmlRenderer) Render(nodes render.Nodes, summary Summary) ([]byte, string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<table><thead><tr><th>Remarks</th><th>Protocol</th><th>Ping</th><th>Avg Speed</th><th>Max Speed</th></tr></thead><tbody>")
+	for _, n := range nodes {
+		fmt.Fprintf(&buf, "<tr><td>%s</td><td>%s</td><td>%sms</td><td>%d</td><td>%d</td></tr>",
+			html.EscapeString(n.Remarks), html.EscapeString(n.Protocol), html.EscapeString(n.Ping), n.AvgSpeed, n.MaxSpeed)
+	}
+	buf.WriteString("</tbody></table>")
+	fmt.Fprintf(&buf, "<p>%d/%d working, %s, %s</p>", summary.SuccessCount, summary.TotalCount, download.ByteCountIECTrim(summary.Traffic), summary.Duration)
+	return buf.Bytes(), "text/html", nil
+}
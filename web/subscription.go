@@ -0,0 +1,325 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xxf098/lite-proxy/common"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSubscriptionFetcher is used whenever a request carries Subscriptions
+// but no caller has wired up a fetcher with a custom *http.Client (e.g. to
+// route through a proxy under test, or a corporate egress proxy).
+var defaultSubscriptionFetcher = NewSubscriptionFetcher(nil)
+
+// subscriptionUserAgent identifies requests made by this package, since some
+// subscription hosts reject or rate-limit clients with no User-Agent at all.
+const subscriptionUserAgent = "LiteSpeedTest"
+
+// maxSubscriptionAttempts bounds the retries FetchAll/Fetch make against a
+// single subscription URL before giving up on it.
+const maxSubscriptionAttempts = 3
+
+// SubscriptionFetcher downloads one or more subscription URLs and turns them
+// into a flat, de-duplicated list of proxy links. It serves the Subscriptions
+// field; the single Subscription field still goes through
+// getSubscriptionLinks, which only understands a base64-encoded blob fetched
+// with a bare http.Client and no retry.
+//
+// It auto-detects four payload shapes per URL:
+//   - a base64-encoded blob of newline-separated proxy links (the original
+//     format)
+//   - plain text with proxy links embedded directly, one per line
+//   - Clash / Clash.Meta YAML, converting its `proxies:` list to
+//     vmess://, ss://, trojan:// and vless:// URIs
+//   - SIP008 JSON (https://shadowsocks.org/doc/sip008.html)
+type SubscriptionFetcher struct {
+	// Client performs the HTTP GET against each subscription URL and must be
+	// non-nil. NewSubscriptionFetcher sets a 20s-timeout client when given
+	// nil, matching the previous behavior; Fetch and FetchAll do not.
+	Client *http.Client
+}
+
+// NewSubscriptionFetcher returns a SubscriptionFetcher that fetches with
+// client. A nil client gets a 20-second-timeout default.
+func NewSubscriptionFetcher(client *http.Client) *SubscriptionFetcher {
+	if client == nil {
+		client = &http.Client{Timeout: 20 * time.Second}
+	}
+	return &SubscriptionFetcher{Client: client}
+}
+
+// Fetch downloads a single subscription URL and returns its links.
+func (f *SubscriptionFetcher) Fetch(link string) ([]string, error) {
+	data, err := f.get(link)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSubscription(data)
+}
+
+// FetchAll downloads every link in urls and merges the results, de-duplicating
+// nodes that resolve to the same (protocol, host, port, uuid/password) so the
+// same server listed in two subscriptions only gets tested once. A URL that
+// fails outright is skipped rather than failing the whole run; FetchAll only
+// errors when none of the URLs yielded anything.
+func (f *SubscriptionFetcher) FetchAll(urls []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, u := range urls {
+		links, err := f.Fetch(u)
+		if err != nil {
+			log.Printf("subscription fetch failed for %s: %v", u, err)
+			continue
+		}
+		for _, link := range links {
+			key := dedupKey(link)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, link)
+		}
+	}
+	if len(merged) == 0 {
+		return nil, ErrInvalidData
+	}
+	return merged, nil
+}
+
+func (f *SubscriptionFetcher) get(link string) ([]byte, error) {
+	var lastErr error
+	for attempt := 0; attempt < maxSubscriptionAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, link, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", subscriptionUserAgent)
+		resp, err := f.Client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("subscription %s: unexpected status %s", link, resp.Status)
+			continue
+		}
+		return data, nil
+	}
+	return nil, lastErr
+}
+
+// decodeSubscription auto-detects the payload format of a subscription
+// response and returns the proxy links it contains.
+func decodeSubscription(data []byte) ([]string, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if links, err := parseSIP008(trimmed); err == nil {
+		return links, nil
+	}
+	if links, err := parseClashYAML(trimmed); err == nil {
+		return links, nil
+	}
+	if links := extractLinks(trimmed); len(links) > 0 {
+		return links, nil
+	}
+	if msg, err := common.DecodeB64(trimmed); err == nil {
+		if links := extractLinks(msg); len(links) > 0 {
+			return links, nil
+		}
+	}
+	return nil, ErrInvalidData
+}
+
+// sip008Server is one entry of a SIP008 document's "servers" array.
+// See https://shadowsocks.org/doc/sip008.html.
+type sip008Server struct {
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+}
+
+type sip008Document struct {
+	Version int            `json:"version"`
+	Servers []sip008Server `json:"servers"`
+}
+
+// parseSIP008 decodes a SIP008 JSON document into ss:// links. It errors on
+// anything that doesn't parse as a SIP008 document, so decodeSubscription can
+// try it as a cheap format probe.
+func parseSIP008(data string) ([]string, error) {
+	if !strings.HasPrefix(data, "{") {
+		return nil, ErrInvalidData
+	}
+	var doc sip008Document
+	if err := json.Unmarshal([]byte(data), &doc); err != nil || len(doc.Servers) == 0 {
+		return nil, ErrInvalidData
+	}
+	links := make([]string, 0, len(doc.Servers))
+	for _, s := range doc.Servers {
+		userinfo := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(
+			[]byte(s.Method + ":" + s.Password))
+		link := fmt.Sprintf("ss://%s@%s:%d", userinfo, s.Server, s.ServerPort)
+		if s.Remarks != "" {
+			link += "#" + url.QueryEscape(s.Remarks)
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// clashProxy is the subset of a Clash / Clash.Meta proxies[] entry this
+// package knows how to convert to a URI.
+type clashProxy struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Server   string `yaml:"server"`
+	Port     int    `yaml:"port"`
+	UUID     string `yaml:"uuid"`
+	Password string `yaml:"password"`
+	Cipher   string `yaml:"cipher"`
+	AlterID  int    `yaml:"alterId"`
+	Network  string `yaml:"network"`
+	TLS      bool   `yaml:"tls"`
+	SNI      string `yaml:"sni"`
+}
+
+type clashDocument struct {
+	Proxies []clashProxy `yaml:"proxies"`
+}
+
+// parseClashYAML decodes a Clash / Clash.Meta config's `proxies:` list and
+// converts each entry it recognizes (vmess, ss, trojan, vless) to the
+// corresponding URI scheme. It errors on anything that isn't YAML with a
+// non-empty proxies list, so decodeSubscription can try it as a format probe.
+func parseClashYAML(data string) ([]string, error) {
+	if !strings.Contains(data, "proxies:") {
+		return nil, ErrInvalidData
+	}
+	var doc clashDocument
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil || len(doc.Proxies) == 0 {
+		return nil, ErrInvalidData
+	}
+	links := make([]string, 0, len(doc.Proxies))
+	for _, p := range doc.Proxies {
+		link, err := clashProxyToLink(p)
+		if err != nil {
+			continue
+		}
+		links = append(links, link)
+	}
+	if len(links) == 0 {
+		return nil, ErrInvalidData
+	}
+	return links, nil
+}
+
+func clashProxyToLink(p clashProxy) (string, error) {
+	switch strings.ToLower(p.Type) {
+	case "vmess":
+		cfg := map[string]interface{}{
+			"v":    "2",
+			"ps":   p.Name,
+			"add":  p.Server,
+			"port": strconv.Itoa(p.Port),
+			"id":   p.UUID,
+			"aid":  strconv.Itoa(p.AlterID),
+			"net":  p.Network,
+			"tls":  map[bool]string{true: "tls", false: ""}[p.TLS],
+			"sni":  p.SNI,
+		}
+		raw, err := json.Marshal(cfg)
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(raw), nil
+	case "ss":
+		userinfo := base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(
+			[]byte(p.Cipher + ":" + p.Password))
+		return fmt.Sprintf("ss://%s@%s:%d#%s", userinfo, p.Server, p.Port, url.QueryEscape(p.Name)), nil
+	case "trojan":
+		return fmt.Sprintf("trojan://%s@%s:%d#%s", url.UserPassword("", p.Password).String()[1:], p.Server, p.Port, url.QueryEscape(p.Name)), nil
+	case "vless":
+		q := url.Values{}
+		if p.TLS {
+			q.Set("security", "tls")
+		}
+		if p.Network != "" {
+			q.Set("type", p.Network)
+		}
+		if p.SNI != "" {
+			q.Set("sni", p.SNI)
+		}
+		u := fmt.Sprintf("vless://%s@%s:%d", p.UUID, p.Server, p.Port)
+		if enc := q.Encode(); enc != "" {
+			u += "?" + enc
+		}
+		return u + "#" + url.QueryEscape(p.Name), nil
+	default:
+		return "", fmt.Errorf("unsupported clash proxy type %q", p.Type)
+	}
+}
+
+// dedupKey returns the (protocol, host, port, uuid/password) identity of a
+// proxy link, used to merge nodes that the same server advertises under
+// multiple subscriptions. Links this package can't parse structurally fall
+// back to the raw link itself, so they're kept rather than dropped.
+func dedupKey(link string) string {
+	scheme, rest, ok := strings.Cut(link, "://")
+	if !ok {
+		return link
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme == "vmess" {
+		payload := strings.SplitN(rest, "#", 2)[0]
+		raw, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			raw, err = base64.RawStdEncoding.DecodeString(payload)
+		}
+		if err != nil {
+			return link
+		}
+		var cfg struct {
+			Add  string `json:"add"`
+			Port string `json:"port"`
+			ID   string `json:"id"`
+		}
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return link
+		}
+		return fmt.Sprintf("vmess|%s|%s|%s", cfg.Add, cfg.Port, cfg.ID)
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Hostname() == "" {
+		return link
+	}
+	id := u.User.Username()
+	if pw, ok := u.User.Password(); ok && pw != "" {
+		id = pw
+	} else if scheme == "ss" {
+		// ss:// commonly packs "method:password" as base64 into the
+		// userinfo slot rather than using a literal user:pass pair.
+		if raw, err := base64.RawURLEncoding.DecodeString(id); err == nil {
+			id = string(raw)
+		} else if raw, err := base64.StdEncoding.DecodeString(id); err == nil {
+			id = string(raw)
+		}
+	}
+	return fmt.Sprintf("%s|%s|%s|%s", scheme, u.Hostname(), u.Port(), id)
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeSubscriptionPlainText(t *testing.T) {
+	const link = "trojan://pass@example.com:443?sni=example.com#node1"
+	links, err := decodeSubscription([]byte(link + "\n"))
+	if err != nil {
+		t.Fatalf("decodeSubscription: %v", err)
+	}
+	if len(links) != 1 || links[0] != link {
+		t.Fatalf("got %v, want [%s]", links, link)
+	}
+}
+
+func TestDecodeSubscriptionBase64Blob(t *testing.T) {
+	const link = "ss://YWVzLTI1Ni1nY206cGFzcw@example.com:8388#node1"
+	blob := base64.StdEncoding.EncodeToString([]byte(link))
+	links, err := decodeSubscription([]byte(blob))
+	if err != nil {
+		t.Fatalf("decodeSubscription: %v", err)
+	}
+	if len(links) != 1 || links[0] != link {
+		t.Fatalf("got %v, want [%s]", links, link)
+	}
+}
+
+func TestDecodeSubscriptionSIP008(t *testing.T) {
+	const doc = `{
+		"version": 1,
+		"servers": [
+			{"id": "1", "remarks": "node1", "server": "example.com", "server_port": 8388, "password": "pass", "method": "aes-256-gcm"}
+		]
+	}`
+	links, err := decodeSubscription([]byte(doc))
+	if err != nil {
+		t.Fatalf("decodeSubscription: %v", err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("got %v, want 1 link", links)
+	}
+	if key := dedupKey(links[0]); key != "ss|example.com|8388|aes-256-gcm:pass" {
+		t.Fatalf("unexpected dedup key %q", key)
+	}
+}
+
+func TestDecodeSubscriptionClashYAML(t *testing.T) {
+	const doc = `
+proxies:
+  - name: node1
+    type: ss
+    server: example.com
+    port: 8388
+    cipher: aes-256-gcm
+    password: pass
+  - name: node2
+    type: vless
+    server: example.org
+    port: 443
+    uuid: 11111111-1111-1111-1111-111111111111
+    network: tcp
+    tls: true
+`
+	links, err := decodeSubscription([]byte(doc))
+	if err != nil {
+		t.Fatalf("decodeSubscription: %v", err)
+	}
+	if len(links) != 2 {
+		t.Fatalf("got %v, want 2 links", links)
+	}
+}
+
+func TestSubscriptionFetcherFetchAllDedup(t *testing.T) {
+	const link = "trojan://pass@example.com:443?sni=example.com#node1"
+	srvA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(link))
+	}))
+	defer srvA.Close()
+	srvB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(link))
+	}))
+	defer srvB.Close()
+
+	f := NewSubscriptionFetcher(nil)
+	links, err := f.FetchAll([]string{srvA.URL, srvB.URL})
+	if err != nil {
+		t.Fatalf("FetchAll: %v", err)
+	}
+	if len(links) != 1 {
+		t.Fatalf("got %d links, want 1 after dedup: %v", len(links), links)
+	}
+}
+
+func TestSubscriptionFetcherFetchAllSkipsFailures(t *testing.T) {
+	const link = "trojan://pass@example.com:443?sni=example.com#node1"
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(link))
+	}))
+	defer ok.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	f := NewSubscriptionFetcher(nil)
+	links, err := f.FetchAll([]string{bad.URL, ok.URL})
+	if err != nil {
+		t.Fatalf("FetchAll: %v", err)
+	}
+	if len(links) != 1 || links[0] != link {
+		t.Fatalf("got %v, want [%s]", links, link)
+	}
+}
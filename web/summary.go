@@ -0,0 +1,67 @@
+package web
+
+import (
+	"sort"
+
+	"github.com/xxf098/lite-proxy/web/render"
+)
+
+// RunSummary is a structured recap of a finished run, emitted as a JSON
+// artifact alongside whatever the configured Renderers produce. It exists
+// so a scheduled health-check job has something to alert on without having
+// to scrape the PNG.
+type RunSummary struct {
+	SuccessCount        int              `json:"successCount"`
+	FailCount           int              `json:"failCount"`
+	Traffic             int64            `json:"traffic"`
+	Duration            string           `json:"duration"`
+	ProtocolMedianSpeed map[string]int64 `json:"protocolMedianSpeed"`
+	TopSpeed            []render.Node    `json:"topSpeed"`
+}
+
+// topSpeedCount bounds how many nodes RunSummary.TopSpeed keeps.
+const topSpeedCount = 5
+
+// buildRunSummary reduces a finished run's nodes into a RunSummary.
+func buildRunSummary(nodes render.Nodes, summary Summary) RunSummary {
+	rs := RunSummary{
+		SuccessCount:        summary.SuccessCount,
+		FailCount:           summary.TotalCount - summary.SuccessCount,
+		Traffic:             summary.Traffic,
+		Duration:            summary.Duration,
+		ProtocolMedianSpeed: map[string]int64{},
+	}
+
+	byProtocol := map[string][]int64{}
+	ranked := make([]render.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if !n.IsOk {
+			continue
+		}
+		byProtocol[n.Protocol] = append(byProtocol[n.Protocol], n.AvgSpeed)
+		ranked = append(ranked, n)
+	}
+	for proto, speeds := range byProtocol {
+		rs.ProtocolMedianSpeed[proto] = median(speeds)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].AvgSpeed > ranked[j].AvgSpeed })
+	if len(ranked) > topSpeedCount {
+		ranked = ranked[:topSpeedCount]
+	}
+	rs.TopSpeed = ranked
+	return rs
+}
+
+func median(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}